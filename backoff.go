@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// streamer is the subset of sshStream that retryStream depends on, so tests
+// can exercise the retry/backoff logic with a fake dialer.
+type streamer interface {
+	Stream(cmd string, timeout int) (<-chan string, <-chan string, <-chan bool, <-chan error, error)
+}
+
+var _ streamer = sshStream{}
+
+// Defaults mirror cenkalti/backoff's ExponentialBackOff defaults.
+const (
+	defaultInitialInterval     = 500 * time.Millisecond
+	defaultMaxInterval         = 60 * time.Second
+	defaultMultiplier          = 1.5
+	defaultRandomizationFactor = 0.5
+)
+
+// backoffConfig configures retryStream's exponential backoff with jitter.
+type backoffConfig struct {
+	InitialInterval     time.Duration
+	MaxInterval         time.Duration
+	Multiplier          float64
+	RandomizationFactor float64
+	MaxElapsedTime      time.Duration
+}
+
+// backoffConfigFromPlugin builds a backoffConfig from Config.Retry* fields,
+// falling back to the defaults above, and to RetryTimeout for
+// MaxElapsedTime for backwards compatibility.
+func backoffConfigFromPlugin(p Plugin) backoffConfig {
+	cfg := backoffConfig{
+		InitialInterval:     p.Config.RetryInitialInterval,
+		MaxInterval:         p.Config.RetryMaxInterval,
+		Multiplier:          p.Config.RetryMultiplier,
+		RandomizationFactor: p.Config.RetryRandomizationFactor,
+		MaxElapsedTime:      p.Config.RetryMaxElapsedTime,
+	}
+
+	if cfg.InitialInterval <= 0 {
+		cfg.InitialInterval = defaultInitialInterval
+	}
+	if cfg.MaxInterval <= 0 {
+		cfg.MaxInterval = defaultMaxInterval
+	}
+	if cfg.Multiplier <= 0 {
+		cfg.Multiplier = defaultMultiplier
+	}
+	if cfg.RandomizationFactor <= 0 {
+		cfg.RandomizationFactor = defaultRandomizationFactor
+	}
+	if cfg.MaxElapsedTime <= 0 {
+		cfg.MaxElapsedTime = p.Config.RetryTimeout
+	}
+
+	return cfg
+}
+
+// backoff hands out successive exponential-with-jitter wait durations,
+// bounded by MaxElapsedTime.
+type backoff struct {
+	cfg     backoffConfig
+	current time.Duration
+	start   time.Time
+}
+
+func newBackoff(cfg backoffConfig) *backoff {
+	return &backoff{
+		cfg:     cfg,
+		current: cfg.InitialInterval,
+		start:   timeNow(),
+	}
+}
+
+// next returns the wait before the next attempt, and false once
+// MaxElapsedTime has been exceeded.
+func (b *backoff) next() (time.Duration, bool) {
+	if b.cfg.MaxElapsedTime > 0 && timeNow().Sub(b.start) >= b.cfg.MaxElapsedTime {
+		return 0, false
+	}
+
+	wait := jitter(b.current, b.cfg.RandomizationFactor)
+
+	next := time.Duration(float64(b.current) * b.cfg.Multiplier)
+	if next > b.cfg.MaxInterval {
+		next = b.cfg.MaxInterval
+	}
+	b.current = next
+
+	return wait, true
+}
+
+// jitter randomizes d by +/- factor, e.g. factor=0.5 returns a value in
+// [0.5*d, 1.5*d].
+func jitter(d time.Duration, factor float64) time.Duration {
+	if factor <= 0 {
+		return d
+	}
+
+	delta := factor * float64(d)
+	min := float64(d) - delta
+	max := float64(d) + delta
+
+	return time.Duration(min + (rand.Float64() * (max - min + 1)))
+}
+
+// timeNow is a var so tests can make backoff deterministic.
+var timeNow = time.Now
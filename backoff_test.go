@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeStreamer fails the first N calls to Stream with a retryable error,
+// then succeeds.
+type fakeStreamer struct {
+	failures int
+	calls    int
+}
+
+func (f *fakeStreamer) Stream(cmd string, timeout int) (<-chan string, <-chan string, <-chan bool, <-chan error, error) {
+	f.calls++
+	if f.calls <= f.failures {
+		return nil, nil, nil, nil, &net.OpError{Op: "dial", Err: &timeoutError{}}
+	}
+
+	stdout := make(chan string, 1)
+	stderr := make(chan string, 1)
+	done := make(chan bool, 1)
+	errChan := make(chan error, 1)
+	done <- true
+	return stdout, stderr, done, errChan, nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryStreamSucceedsAfterFailures(t *testing.T) {
+	fake := &fakeStreamer{failures: 3}
+	p := Plugin{Config: Config{
+		RetryInitialInterval: time.Millisecond,
+		RetryMaxInterval:     5 * time.Millisecond,
+		RetryMaxElapsedTime:  time.Second,
+	}}
+
+	_, _, done, _, attempt, err := retryStream(context.Background(), fake, "example.com", p)
+	if err != nil {
+		t.Fatalf("expected retryStream to succeed, got error: %v", err)
+	}
+	if fake.calls != 4 {
+		t.Fatalf("expected 4 calls (3 failures + 1 success), got %d", fake.calls)
+	}
+	if attempt != 4 {
+		t.Fatalf("expected the successful attempt to be reported as 4, got %d", attempt)
+	}
+	if !<-done {
+		t.Fatalf("expected done channel to report success")
+	}
+}
+
+func TestRetryStreamGivesUpAfterMaxElapsedTime(t *testing.T) {
+	fake := &fakeStreamer{failures: 1000}
+	p := Plugin{Config: Config{
+		RetryInitialInterval: time.Millisecond,
+		RetryMaxInterval:     2 * time.Millisecond,
+		RetryMaxElapsedTime:  20 * time.Millisecond,
+	}}
+
+	_, _, _, _, _, err := retryStream(context.Background(), fake, "example.com", p)
+	if err == nil {
+		t.Fatalf("expected retryStream to give up and return an error")
+	}
+}
+
+func TestIsRetryableError(t *testing.T) {
+	if isRetryableError(nil) {
+		t.Fatalf("nil error should not be retryable")
+	}
+
+	timeoutErr := &net.OpError{Op: "dial", Err: &timeoutError{}}
+	if !isRetryableError(timeoutErr) {
+		t.Fatalf("expected timeout net.OpError to be retryable")
+	}
+
+	dnsErr := &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nxdomain.invalid", IsNotFound: true}}
+	if isRetryableError(dnsErr) {
+		t.Fatalf("expected DNS not-found error to be terminal, not retryable")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// dial opens an *ssh.Client to host, routing through Config.Proxy when one
+// is configured. Shared by the upload and exec phases so both authenticate
+// and verify host keys identically. The TCP dial(s) abort promptly if ctx
+// is cancelled; ctx does not bound the lifetime of the returned client.
+func (p Plugin) dial(ctx context.Context, host string) (*ssh.Client, error) {
+	hostKeyCallback, err := newHostKeyCallback(p.Config.StrictHostKeyChecking, p.Config.Fingerprint, p.Config.KnownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	clientConfig, err := sshClientConfig(
+		p.Config.UserName, p.Config.Key, p.Config.KeyPath, p.Config.KeyPassphrase,
+		p.Config.Password, p.Config.UseSSHAgent, p.Config.Timeout, hostKeyCallback,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(host, strconv.Itoa(p.Config.Port))
+
+	var client *ssh.Client
+	if p.Config.Proxy.Server == "" {
+		client, err = dialContext(ctx, addr, clientConfig)
+	} else {
+		client, err = p.dialViaProxy(ctx, addr, clientConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Config.UseSSHAgent && p.Config.AgentForwarding {
+		if err := forwardAgent(client); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to forward ssh agent to %s: %w", host, err)
+		}
+	}
+
+	return client, nil
+}
+
+// dialViaProxy reaches addr by first connecting to Config.Proxy, then
+// tunnelling a new SSH connection to addr over that connection.
+func (p Plugin) dialViaProxy(ctx context.Context, addr string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	proxyHostKeyCallback, err := newHostKeyCallback(p.Config.Proxy.StrictHostKeyChecking, p.Config.Proxy.Fingerprint, p.Config.Proxy.KnownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyConfig, err := sshClientConfig(
+		p.Config.Proxy.User, p.Config.Proxy.Key, p.Config.Proxy.KeyPath, "",
+		p.Config.Proxy.Password, false, p.Config.Proxy.Timeout, proxyHostKeyCallback,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyAddr := net.JoinHostPort(p.Config.Proxy.Server, p.Config.Proxy.Port)
+	proxyClient, err := dialContext(ctx, proxyAddr, proxyConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %w", proxyAddr, err)
+	}
+
+	conn, err := proxyClient.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach %s via proxy %s: %w", addr, proxyAddr, err)
+	}
+
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewClient(ncc, chans, reqs), nil
+}
+
+// forwardAgent exposes the local SSH_AUTH_SOCK agent to client, so a session
+// opened on it can in turn request forwarding to reach a further host.
+func forwardAgent(client *ssh.Client) error {
+	sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return fmt.Errorf("failed to connect to SSH_AUTH_SOCK: %w", err)
+	}
+
+	return agent.ForwardToAgent(client, agent.NewClient(sock))
+}
+
+// dialContext is ssh.Dial with the initial TCP connect bound to ctx, so
+// callers can abort a pending connection promptly (e.g. on fail-fast).
+func dialContext(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	d := net.Dialer{Timeout: config.Timeout}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ncc, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.NewClient(ncc, chans, reqs), nil
+}
+
+// sshClientConfig builds a raw ssh.ClientConfig, using the same
+// Key/KeyPath/Password/UseSSHAgent precedence as the rest of Config.
+func sshClientConfig(user, key, keyPath, passphrase, password string, useAgent bool, timeout time.Duration, hostKeyCallback ssh.HostKeyCallback) (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+
+	switch {
+	case useAgent:
+		sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to SSH_AUTH_SOCK: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(sock).Signers))
+	case key != "" || keyPath != "":
+		raw := []byte(key)
+		if keyPath != "" {
+			var err error
+			raw, err = os.ReadFile(keyPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read KeyPath %s: %w", keyPath, err)
+			}
+		}
+
+		var signer ssh.Signer
+		var err error
+		if passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(raw, []byte(passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	case password != "":
+		// Some servers prompt via keyboard-interactive instead of (or as
+		// well as) the password method; answer every prompt with password,
+		// as a fallback, the same way packer's SSH communicator does.
+		auth = append(auth,
+			ssh.Password(password),
+			ssh.KeyboardInteractive(passwordKeyboardInteractive(password)),
+		)
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}, nil
+}
+
+// passwordKeyboardInteractive answers every keyboard-interactive prompt with
+// password, regardless of its text.
+func passwordKeyboardInteractive(password string) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i := range answers {
+			answers[i] = password
+		}
+		return answers, nil
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeAddr builds the remote address handed to host key callbacks, without
+// opening a real connection. It is a *net.TCPAddr (on a documentation IP,
+// with hostport's port) because the knownhosts callback rejects any other
+// net.Addr.
+func fakeAddr(hostport string) net.Addr {
+	_, port, _ := net.SplitHostPort(hostport)
+	portNum, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: portNum}
+}
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate test key: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("failed to convert test key: %v", err)
+	}
+	return sshPub
+}
+
+func TestNewHostKeyCallback(t *testing.T) {
+	key := newTestHostKey(t)
+	other := newTestHostKey(t)
+	const addr = "example.com:22"
+
+	t.Run("empty mode defaults to no and accepts any key", func(t *testing.T) {
+		cb, err := newHostKeyCallback("", "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := cb(addr, fakeAddr(addr), key); err != nil {
+			t.Fatalf("expected any host key to be accepted, got: %v", err)
+		}
+	})
+
+	t.Run("no accepts any key", func(t *testing.T) {
+		cb, err := newHostKeyCallback(StrictHostKeyCheckingNo, "", "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := cb(addr, fakeAddr(addr), other); err != nil {
+			t.Fatalf("expected any host key to be accepted, got: %v", err)
+		}
+	})
+
+	t.Run("yes without fingerprint or known_hosts errors", func(t *testing.T) {
+		if _, err := newHostKeyCallback(StrictHostKeyCheckingYes, "", ""); err == nil {
+			t.Fatalf("expected an error")
+		}
+	})
+
+	t.Run("yes with a matching fingerprint succeeds", func(t *testing.T) {
+		cb, err := newHostKeyCallback(StrictHostKeyCheckingYes, fingerprintSHA256(key), "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := cb(addr, fakeAddr(addr), key); err != nil {
+			t.Fatalf("expected a matching fingerprint to be accepted, got: %v", err)
+		}
+	})
+
+	t.Run("yes with a mismatched fingerprint fails", func(t *testing.T) {
+		cb, err := newHostKeyCallback(StrictHostKeyCheckingYes, fingerprintSHA256(other), "")
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := cb(addr, fakeAddr(addr), key); err == nil {
+			t.Fatalf("expected a mismatched fingerprint to be rejected")
+		}
+	})
+
+	t.Run("accept-new records an unseen host then matches it on replay", func(t *testing.T) {
+		knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+		cb, err := newHostKeyCallback(StrictHostKeyCheckingAcceptNew, "", knownHosts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := cb(addr, fakeAddr(addr), key); err != nil {
+			t.Fatalf("expected an unseen host to be recorded, got: %v", err)
+		}
+
+		cb, err = newHostKeyCallback(StrictHostKeyCheckingAcceptNew, "", knownHosts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := cb(addr, fakeAddr(addr), key); err != nil {
+			t.Fatalf("expected a previously recorded host key to match, got: %v", err)
+		}
+		if err := cb(addr, fakeAddr(addr), other); err == nil {
+			t.Fatalf("expected a changed host key to be rejected")
+		}
+	})
+
+	t.Run("yes with known_hosts rejects an unrecorded host", func(t *testing.T) {
+		knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+
+		cb, err := newHostKeyCallback(StrictHostKeyCheckingYes, "", knownHosts)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if err := cb(addr, fakeAddr(addr), key); err == nil {
+			t.Fatalf("expected an unrecorded host to be rejected under StrictHostKeyChecking=yes")
+		}
+	})
+
+	t.Run("invalid mode errors", func(t *testing.T) {
+		if _, err := newHostKeyCallback("maybe", "", ""); err == nil {
+			t.Fatalf("expected an error for an invalid mode")
+		}
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// LogFormat values for Config.LogFormat.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// HostResult is the outcome of running the upload/exec phases on a single
+// host, returned from Exec alongside its aggregated error so callers
+// embedding Plugin as a library can inspect partial failures.
+type HostResult struct {
+	Host string `json:"host"`
+	// ExitCode is 0 on success, the remote command's real exit status when
+	// known, 1 for failures that didn't come from a command exit (e.g.
+	// a failed connection or upload), or -1 for a host that was skipped or
+	// cancelled before it ran.
+	ExitCode   int    `json:"exit_code"`
+	DurationMs int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// logLine is one line of streaming output when Config.LogFormat is "json".
+type logLine struct {
+	Host    string `json:"host"`
+	Stream  string `json:"stream"`
+	Ts      string `json:"ts"`
+	Msg     string `json:"msg"`
+	Attempt int    `json:"attempt,omitempty"`
+}
+
+// log writes a single free-form line for host, tagged as coming from the
+// "system" stream (as opposed to a command's stdout/stderr).
+func (p Plugin) log(host string, message ...interface{}) {
+	p.logAttempt(host, "system", 0, fmt.Sprint(message...))
+}
+
+// logAttempt writes one line of output for host, tagging it with the
+// stream it came from ("stdout", "stderr" or "system") and the retry
+// attempt it was produced on. In text mode this renders as "host: msg" (just
+// "msg" when Config.Host has a single host), with stdout and stderr lines
+// prefixed "out: " and "err: "; in json mode it is one logLine object per
+// call.
+func (p Plugin) logAttempt(host, stream string, attempt int, msg string) {
+	if p.Writer == nil {
+		p.Writer = os.Stdout
+	}
+
+	if p.Config.LogFormat == LogFormatJSON {
+		line := logLine{
+			Host:    host,
+			Stream:  stream,
+			Ts:      time.Now().UTC().Format(time.RFC3339Nano),
+			Msg:     msg,
+			Attempt: attempt,
+		}
+		if err := json.NewEncoder(p.Writer).Encode(line); err != nil {
+			fmt.Fprintln(p.Writer, msg)
+		}
+		return
+	}
+
+	switch stream {
+	case "stdout":
+		msg = "out: " + msg
+	case "stderr":
+		msg = "err: " + msg
+	}
+
+	if count := len(p.Config.Host); count == 1 {
+		fmt.Fprintln(p.Writer, msg)
+	} else {
+		fmt.Fprintf(p.Writer, "%s: %s\n", host, msg)
+	}
+}
+
+// logSummary announces that every host succeeded. It is a no-op in json
+// mode, where bare banner lines would break an NDJSON consumer; text mode
+// has no other signal that the whole run succeeded.
+func (p Plugin) logSummary() {
+	if p.Config.LogFormat == LogFormatJSON {
+		return
+	}
+
+	if p.Writer == nil {
+		p.Writer = os.Stdout
+	}
+
+	fmt.Fprintln(p.Writer, "==========================================")
+	fmt.Fprintln(p.Writer, "Successfully executed commands to all host.")
+	fmt.Fprintln(p.Writer, "==========================================")
+}
+
+// logResult emits the final per-host summary. It is a no-op in text mode,
+// where per-line output already conveys success or failure.
+func (p Plugin) logResult(result HostResult) {
+	if p.Config.LogFormat != LogFormatJSON {
+		return
+	}
+
+	if p.Writer == nil {
+		p.Writer = os.Stdout
+	}
+
+	if err := json.NewEncoder(p.Writer).Encode(result); err != nil {
+		fmt.Fprintf(p.Writer, "%s: %+v\n", result.Host, result)
+	}
+}
@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/appleboy/easyssh-proxy"
 	"io"
 	"net"
+	"syscall"
+)
+
+// StrictHostKeyChecking modes, mirroring OpenSSH's ssh_config option of the
+// same name.
+const (
+	StrictHostKeyCheckingYes       = "yes"
+	StrictHostKeyCheckingNo        = "no"
+	StrictHostKeyCheckingAcceptNew = "accept-new"
 )
 
 const (
@@ -18,6 +28,7 @@ const (
 	missingPasswordOrKey = "Error: can't connect without a private SSH key or password"
 	commandTimeOut       = "Error: command timeout"
 	setPasswordandKey    = "can't set password and key at the same time"
+	missingSSHAuthSock   = "Error: UseSSHAgent is set but SSH_AUTH_SOCK is not present in the environment"
 )
 
 type (
@@ -35,9 +46,99 @@ type (
 		Script         []string
 		Secrets        []string
 		Envs           []string
-		Proxy          easyssh.DefaultConfig
+		Proxy          ProxyConfig
 		Debug          bool
 		Sync           bool
+
+		// RetryInitialInterval is the wait before the first retry. Defaults
+		// to 500ms when zero.
+		RetryInitialInterval time.Duration
+		// RetryMaxInterval caps how large the backoff can grow. Defaults to
+		// 60s when zero.
+		RetryMaxInterval time.Duration
+		// RetryMultiplier scales the wait after each failed attempt.
+		// Defaults to 1.5 when zero.
+		RetryMultiplier float64
+		// RetryRandomizationFactor adds +/- jitter to each wait, as a
+		// fraction of it. Defaults to 0.5 when zero.
+		RetryRandomizationFactor float64
+		// RetryMaxElapsedTime bounds the total time spent retrying. Falls
+		// back to RetryTimeout, kept for backwards compatibility, when
+		// zero.
+		RetryMaxElapsedTime time.Duration
+
+		// Fingerprint is the expected SHA256 fingerprint of the remote host
+		// key, e.g. "SHA256:abcd...". When set it takes precedence over
+		// KnownHostsPath.
+		Fingerprint string
+		// KnownHostsPath is an OpenSSH known_hosts file used to verify the
+		// remote host key.
+		KnownHostsPath string
+		// StrictHostKeyChecking controls how the remote host key is
+		// verified: "no" (default, accept any host key, the previous
+		// behaviour), "yes" (require a match in Fingerprint or
+		// KnownHostsPath) or "accept-new" (trust and record host keys not
+		// yet seen, matching ones already recorded). "yes" and "accept-new"
+		// both require Fingerprint or KnownHostsPath to be set.
+		StrictHostKeyChecking string
+
+		// KeyPassphrase decrypts Key/KeyPath when they hold a
+		// password-protected PEM private key.
+		KeyPassphrase string
+		// UseSSHAgent authenticates via the agent listening on
+		// SSH_AUTH_SOCK instead of Key, KeyPath or Password.
+		UseSSHAgent bool
+		// AgentForwarding forwards UseSSHAgent's agent connection to the
+		// remote host, so it can in turn be used to reach a further host.
+		AgentForwarding bool
+
+		// Source files (glob patterns allowed) to upload before Script
+		// runs. When set alongside Script, upload runs first and the
+		// script is not run on a host where upload failed.
+		Source []string
+		// Target is the remote directory Source is uploaded into.
+		Target string
+		// StripComponents removes this many leading path elements from
+		// each Source path before it is joined onto Target. The file name
+		// itself is always kept.
+		StripComponents int
+		// Overwrite allows uploads to replace an existing remote file.
+		// Without it, an existing file aborts the upload.
+		Overwrite bool
+
+		// LogFormat selects how output is written: "text" (default,
+		// "host: line", or just "line" for a single host) or "json", which
+		// emits one logLine object per
+		// output line plus a final HostResult object per host.
+		LogFormat string
+
+		// Parallelism bounds how many hosts run at once. Defaults to
+		// running every host at once (the previous behaviour) when zero.
+		// Ignored when Sync is set, which always runs one host at a time.
+		Parallelism int
+		// FailFast cancels in-flight and not-yet-started hosts as soon as
+		// one host fails. Takes priority over ContinueOnError: a cancelled
+		// host is reported as skipped even when ContinueOnError is set.
+		FailFast bool
+		// ContinueOnError keeps dispatching the remaining hosts after one
+		// fails, instead of the default of letting in-flight hosts finish
+		// but not starting new ones. Has no effect on hosts FailFast has
+		// already cancelled.
+		ContinueOnError bool
+	}
+
+	// ProxyConfig describes an optional SSH jump host used to reach Host.
+	ProxyConfig struct {
+		Server                string
+		User                  string
+		Password              string
+		Key                   string
+		KeyPath               string
+		Port                  string
+		Timeout               time.Duration
+		Fingerprint           string
+		KnownHostsPath        string
+		StrictHostKeyChecking string
 	}
 
 	// Plugin structure
@@ -51,27 +152,38 @@ func escapeArg(arg string) string {
 	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
 }
 
-func (p Plugin) exec(host string, wg *sync.WaitGroup, errChannel chan error) {
-	// Create MakeConfig instance with remote username, server address and path to private key.
-	ssh := &easyssh.MakeConfig{
-		Server:   host,
-		User:     p.Config.UserName,
-		Password: p.Config.Password,
-		Port:     strconv.Itoa(p.Config.Port),
-		Key:      p.Config.Key,
-		KeyPath:  p.Config.KeyPath,
-		Timeout:  p.Config.Timeout,
-		Proxy: easyssh.DefaultConfig{
-			Server:   p.Config.Proxy.Server,
-			User:     p.Config.Proxy.User,
-			Password: p.Config.Proxy.Password,
-			Port:     p.Config.Proxy.Port,
-			Key:      p.Config.Proxy.Key,
-			KeyPath:  p.Config.Proxy.KeyPath,
-			Timeout:  p.Config.Proxy.Timeout,
-		},
+// execHost runs, in order, the upload phase (if Source is set) and the
+// script execution phase (if Script is set) for a single host, then reports
+// a HostResult summarizing the outcome.
+func (p Plugin) execHost(ctx context.Context, host string) HostResult {
+	start := time.Now()
+
+	var runErr error
+	if len(p.Config.Source) > 0 {
+		runErr = p.upload(ctx, host)
+	}
+
+	if runErr == nil && len(p.Config.Script) > 0 {
+		runErr = p.exec(ctx, host)
+	}
+
+	result := HostResult{Host: host, DurationMs: time.Since(start).Milliseconds()}
+	if runErr != nil {
+		result.ExitCode = 1
+		var exitErr *exitCodeError
+		if errors.As(runErr, &exitErr) {
+			result.ExitCode = exitErr.code
+		}
+		result.Error = runErr.Error()
 	}
 
+	p.logResult(result)
+	return result
+}
+
+func (p Plugin) exec(ctx context.Context, host string) error {
+	stream := sshStream{ctx: ctx, host: host, p: p}
+
 	p.log(host, "======CMD======")
 	p.log(host, strings.Join(p.Config.Script, "\n"))
 	p.log(host, "======END======")
@@ -92,123 +204,235 @@ func (p Plugin) exec(host string, wg *sync.WaitGroup, errChannel chan error) {
 		p.log(host, "======END======")
 	}
 
-	stdoutChan, stderrChan, doneChan, errChan, err := retryStream(ssh, p)
+	stdoutChan, stderrChan, doneChan, errChan, attempt, err := retryStream(ctx, stream, host, p)
 	if err != nil {
-		errChannel <- err
-	} else {
-		// read from the output channel until the done signal is passed
-		isTimeout := true
-	loop:
-		for {
-			select {
-			case isTimeout = <-doneChan:
-				break loop
-			case outline := <-stdoutChan:
-				p.log(host, "out:", outline)
-			case errline := <-stderrChan:
-				p.log(host, "err:", errline)
-			case err = <-errChan:
-			}
-		}
+		return err
+	}
 
-		// get exit code or command error.
-		if err != nil {
-			errChannel <- err
+	// read from the output channel until the done signal is passed
+	isTimeout := true
+	var cmdErr error
+loop:
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case isTimeout = <-doneChan:
+			break loop
+		case outline := <-stdoutChan:
+			p.logAttempt(host, "stdout", attempt, outline)
+		case errline := <-stderrChan:
+			p.logAttempt(host, "stderr", attempt, errline)
+		case cmdErr = <-errChan:
 		}
+	}
 
-		// command time out
-		if !isTimeout {
-			errChannel <- fmt.Errorf(commandTimeOut)
+	// finishSession sends on errChan before doneChan, so an exit error the
+	// select above passed over is already buffered.
+	if cmdErr == nil {
+		select {
+		case cmdErr = <-errChan:
+		default:
 		}
 	}
 
-	wg.Done()
-}
-
-func (p Plugin) log(host string, message ...interface{}) {
-	if p.Writer == nil {
-		p.Writer = os.Stdout
-	}
-	if count := len(p.Config.Host); count == 1 {
-		fmt.Fprintf(p.Writer, "%s", fmt.Sprintln(message...))
-	} else {
-		fmt.Fprintf(p.Writer, "%s: %s", host, fmt.Sprintln(message...))
+	// command time out
+	if !isTimeout {
+		return errors.Join(cmdErr, fmt.Errorf(commandTimeOut))
 	}
+
+	return cmdErr
 }
 
-// Exec executes the plugin.
-func (p Plugin) Exec() error {
+// Exec executes the plugin, running Config.Parallelism hosts at a time (all
+// of them at once by default, or one at a time when Sync is set), and
+// returns a HostResult per host alongside the aggregated error.
+func (p Plugin) Exec() ([]HostResult, error) {
 	if len(p.Config.Host) == 0 && len(p.Config.UserName) == 0 {
-		return fmt.Errorf(missingHostOrUser)
+		return nil, fmt.Errorf(missingHostOrUser)
 	}
 
-	if len(p.Config.Key) == 0 && len(p.Config.Password) == 0 && len(p.Config.KeyPath) == 0 {
-		return fmt.Errorf(missingPasswordOrKey)
+	if len(p.Config.Key) == 0 && len(p.Config.Password) == 0 && len(p.Config.KeyPath) == 0 && !p.Config.UseSSHAgent {
+		return nil, fmt.Errorf(missingPasswordOrKey)
 	}
 
 	if len(p.Config.Key) != 0 && len(p.Config.Password) != 0 {
-		return fmt.Errorf(setPasswordandKey)
-	}
-
-	wg := sync.WaitGroup{}
-	wg.Add(len(p.Config.Host))
-	errChannel := make(chan error, 1)
-	finished := make(chan bool, 1)
-	for _, host := range p.Config.Host {
-		if p.Config.Sync {
-			p.exec(host, &wg, errChannel)
-		} else {
-			go p.exec(host, &wg, errChannel)
-		}
+		return nil, fmt.Errorf(setPasswordandKey)
 	}
 
-	go func() {
-		wg.Wait()
-		close(finished)
-	}()
+	if p.Config.UseSSHAgent && os.Getenv("SSH_AUTH_SOCK") == "" {
+		return nil, fmt.Errorf(missingSSHAuthSock)
+	}
 
-	select {
-	case <-finished:
-	case err := <-errChannel:
-		if err != nil {
-			return err
+	parallelism := p.Config.Parallelism
+	if p.Config.Sync {
+		parallelism = 1
+	}
+	if parallelism <= 0 || parallelism > len(p.Config.Host) {
+		parallelism = len(p.Config.Host)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	hostResults, errs := runHosts(ctx, p.Config.Host, parallelism, p.Config.FailFast, p.Config.ContinueOnError, p.execHost)
+
+	// Hosts skipped or cancelled before they ran never reach execHost, so
+	// their results are logged here.
+	for _, result := range hostResults {
+		if result.ExitCode == -1 {
+			p.logResult(result)
 		}
 	}
 
-	fmt.Println("==========================================")
-	fmt.Println("Successfully executed commands to all host.")
-	fmt.Println("==========================================")
+	if len(errs) > 0 {
+		return hostResults, errors.Join(errs...)
+	}
 
-	return nil
+	p.logSummary()
+
+	return hostResults, nil
 }
 
-func retryStream(ssh *easyssh.MakeConfig, p Plugin) (<-chan string, <-chan string, <-chan bool, <-chan error, error) {
+// runHosts dispatches run across hosts with up to parallelism workers at
+// once. Once any host's result carries an Error, queued hosts are skipped
+// (reported with ExitCode -1) unless continueOnError is set; failFast
+// additionally cancels ctx, so run can abort in-flight work. Split out of
+// Exec so the dispatch/fail-fast/continue-on-error behaviour can be tested
+// with a fake run, without a real SSH connection.
+func runHosts(ctx context.Context, hosts []string, parallelism int, failFast, continueOnError bool, run func(context.Context, string) HostResult) ([]HostResult, []error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hostChan := make(chan string, len(hosts))
+	for _, host := range hosts {
+		hostChan <- host
+	}
+	close(hostChan)
+
+	results := make(chan HostResult, len(hosts))
+
 	var (
-		timeout = time.After(p.Config.RetryTimeout)
-		wait    = time.Second
+		errMu        sync.Mutex
+		errs         []error
+		stopDispatch atomic.Bool
 	)
 
-	for {
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+	for i := 0; i < parallelism; i++ {
+		go func() {
+			defer wg.Done()
+			for host := range hostChan {
+				if stopDispatch.Load() && !continueOnError {
+					results <- HostResult{Host: host, ExitCode: -1, Error: "skipped: a previous host failed"}
+					continue
+				}
+
+				select {
+				case <-ctx.Done():
+					results <- HostResult{Host: host, ExitCode: -1, Error: ctx.Err().Error()}
+					continue
+				default:
+				}
+
+				result := run(ctx, host)
+				results <- result
+
+				if result.Error != "" {
+					errMu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %s", result.Host, result.Error))
+					errMu.Unlock()
+
+					stopDispatch.Store(true)
+					if failFast {
+						cancel()
+					}
+				}
+			}
+		}()
+	}
+
+	// Guarantees all workers return, even once fail-fast cancellation or
+	// stopDispatch has made them skip their remaining queued hosts.
+	wg.Wait()
+	close(results)
+
+	hostResults := make([]HostResult, 0, len(hosts))
+	for result := range results {
+		hostResults = append(hostResults, result)
+	}
+
+	return hostResults, errs
+}
+
+func retryStream(ctx context.Context, ssh streamer, host string, p Plugin) (<-chan string, <-chan string, <-chan bool, <-chan error, int, error) {
+	b := newBackoff(backoffConfigFromPlugin(p))
+
+	for attempt := 1; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return nil, nil, nil, nil, attempt, ctx.Err()
+		default:
+		}
+
 		stdoutChan, stderrChan, doneChan, errChan, err := ssh.Stream(strings.Join(p.Config.Script, "\n"), p.Config.CommandTimeout)
 
 		// If there was no error, return all channels
 		if err == nil {
-			return stdoutChan, stderrChan, doneChan, errChan, nil
+			return stdoutChan, stderrChan, doneChan, errChan, attempt, nil
+		}
+
+		// Terminal errors (e.g. auth failures) are not worth retrying.
+		if !isRetryableError(err) {
+			return nil, nil, nil, nil, attempt, err
 		}
 
-		// If the error was not a net.OpError, return that error
-		if _, ok := err.(*net.OpError); !ok {
-			return nil, nil, nil, nil, err
+		wait, ok := b.next()
+		if !ok {
+			return nil, nil, nil, nil, attempt, err
 		}
 
+		p.logAttempt(host, "system", attempt, fmt.Sprintf("retrying in %s (attempt %d): %s", wait, attempt, err))
+
 		select {
-		case <-timeout:
-			return nil, nil, nil, nil, err
+		case <-ctx.Done():
+			return nil, nil, nil, nil, attempt, ctx.Err()
 		case <-time.After(wait):
-			break
 		}
+	}
+}
+
+// isRetryableError reports whether err is transient and worth retrying, as
+// opposed to a terminal failure like a rejected auth method.
+func isRetryableError(err error) bool {
+	if err == nil {
+		return false
+	}
 
-		// Double our back-off time
-		wait *= 2
+	if errors.Is(err, io.EOF) {
+		return true
 	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		if opErr.Timeout() {
+			return true
+		}
+
+		var sysErr *os.SyscallError
+		if errors.As(opErr.Err, &sysErr) {
+			return sysErr.Err == syscall.ECONNREFUSED || sysErr.Err == syscall.ECONNRESET
+		}
+
+		// DNS failures (e.g. NXDOMAIN) are terminal: retrying won't help.
+		var dnsErr *net.DNSError
+		if errors.As(opErr.Err, &dnsErr) {
+			return false
+		}
+
+		return true
+	}
+
+	return false
 }
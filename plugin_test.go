@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"testing"
+)
+
+// failingHostRun returns a run func for runHosts that fails every host in
+// failAt and succeeds on every other host at once, without real SSH
+// connections.
+func failingHostRun(failAt map[string]bool) func(context.Context, string) HostResult {
+	return func(ctx context.Context, host string) HostResult {
+		if failAt[host] {
+			return HostResult{Host: host, ExitCode: 1, Error: "boom"}
+		}
+		return HostResult{Host: host}
+	}
+}
+
+func resultsByHost(results []HostResult) map[string]HostResult {
+	m := make(map[string]HostResult, len(results))
+	for _, r := range results {
+		m[r.Host] = r
+	}
+	return m
+}
+
+func TestRunHostsContinueOnErrorRunsEveryHost(t *testing.T) {
+	hosts := []string{"a", "b", "c"}
+	results, errs := runHosts(context.Background(), hosts, 1, false, true, failingHostRun(map[string]bool{"a": true}))
+
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly 1 error, got %d: %v", len(errs), errs)
+	}
+
+	byHost := resultsByHost(results)
+	for _, host := range hosts {
+		if byHost[host].Error == "skipped: a previous host failed" {
+			t.Fatalf("host %s should not have been skipped when ContinueOnError is set", host)
+		}
+	}
+}
+
+func TestRunHostsStopsDispatchAfterFailureWithoutContinueOnError(t *testing.T) {
+	hosts := []string{"a", "b", "c"}
+	// parallelism 1 guarantees hosts run in order, so a's failure is
+	// observed before b/c are dispatched.
+	results, errs := runHosts(context.Background(), hosts, 1, false, false, failingHostRun(map[string]bool{"a": true}))
+
+	if len(errs) != 1 {
+		t.Fatalf("expected exactly 1 error, got %d: %v", len(errs), errs)
+	}
+
+	byHost := resultsByHost(results)
+	if byHost["b"].Error != "skipped: a previous host failed" || byHost["c"].Error != "skipped: a previous host failed" {
+		t.Fatalf("expected b and c to be skipped after a failed, got: %+v", byHost)
+	}
+}
+
+func TestRunHostsFailFastCancelsInFlightHosts(t *testing.T) {
+	hosts := []string{"a", "b"}
+
+	// Whichever of the two workers lands on host "a" fails immediately;
+	// whichever lands on "b" blocks on ctx, which fail-fast must cancel
+	// once "a" fails, whether "b" was already running or is still waiting
+	// to be dispatched.
+	run := func(ctx context.Context, host string) HostResult {
+		if host == "a" {
+			return HostResult{Host: host, ExitCode: 1, Error: "boom"}
+		}
+
+		<-ctx.Done()
+		return HostResult{Host: host, ExitCode: -1, Error: ctx.Err().Error()}
+	}
+
+	results, errs := runHosts(context.Background(), hosts, 2, true, true, run)
+
+	// Depending on scheduling, host b is either turned away by runHosts'
+	// own pre-dispatch ctx.Done() check (no error recorded for it) or runs
+	// and observes cancellation itself (an error is recorded) - either way
+	// "a"'s failure must be reported and "b" must not report success.
+	if len(errs) == 0 {
+		t.Fatalf("expected at least 1 error, got none")
+	}
+
+	byHost := resultsByHost(results)
+	if byHost["a"].Error == "" {
+		t.Fatalf("expected host a's result to report its failure, got: %+v", byHost["a"])
+	}
+	if byHost["b"].Error == "" {
+		t.Fatalf("expected host b's result to report the cancellation, got: %+v", byHost["b"])
+	}
+}
+
+func TestRunHostsRespectsParallelism(t *testing.T) {
+	hosts := make([]string, 6)
+	for i := range hosts {
+		hosts[i] = fmt.Sprintf("host-%d", i)
+	}
+
+	var current, max atomic.Int32
+	run := func(ctx context.Context, host string) HostResult {
+		n := current.Add(1)
+		defer current.Add(-1)
+
+		for {
+			m := max.Load()
+			if n <= m || max.CompareAndSwap(m, n) {
+				break
+			}
+		}
+
+		return HostResult{Host: host}
+	}
+
+	results, errs := runHosts(context.Background(), hosts, 2, false, false, run)
+
+	if len(errs) != 0 {
+		t.Fatalf("expected no errors, got: %v", errs)
+	}
+	if len(results) != len(hosts) {
+		t.Fatalf("expected a result for every host, got %d", len(results))
+	}
+	if max.Load() > 2 {
+		t.Fatalf("expected at most 2 hosts running at once, observed %d", max.Load())
+	}
+
+	gotHosts := make([]string, len(results))
+	for i, r := range results {
+		gotHosts[i] = r.Host
+	}
+	sort.Strings(gotHosts)
+	sort.Strings(hosts)
+	for i := range hosts {
+		if gotHosts[i] != hosts[i] {
+			t.Fatalf("expected every host to have a result, got %v", gotHosts)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshStream implements streamer directly on top of golang.org/x/crypto/ssh,
+// opening a fresh connection and session for every call so each retry
+// attempt starts clean.
+type sshStream struct {
+	ctx  context.Context
+	host string
+	p    Plugin
+}
+
+// Stream runs cmd on a freshly dialed session, satisfying the streamer
+// interface that retryStream depends on.
+func (s sshStream) Stream(cmd string, timeout int) (<-chan string, <-chan string, <-chan bool, <-chan error, error) {
+	client, err := s.p.dial(s.ctx, s.host)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		client.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	if s.p.Config.UseSSHAgent && s.p.Config.AgentForwarding {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			session.Close()
+			client.Close()
+			return nil, nil, nil, nil, fmt.Errorf("failed to request agent forwarding: %w", err)
+		}
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		client.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		session.Close()
+		client.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	if err := session.Start(cmd); err != nil {
+		session.Close()
+		client.Close()
+		return nil, nil, nil, nil, err
+	}
+
+	stdoutChan := make(chan string)
+	stderrChan := make(chan string)
+	doneChan := make(chan bool, 1)
+	errChan := make(chan error, 1)
+
+	var linesWg sync.WaitGroup
+	linesWg.Add(2)
+	go scanLines(s.ctx, stdout, stdoutChan, &linesWg)
+	go scanLines(s.ctx, stderr, stderrChan, &linesWg)
+
+	waitChan := make(chan error, 1)
+	go func() {
+		linesWg.Wait()
+		waitChan <- session.Wait()
+	}()
+
+	// Closing the session unblocks the scanLines goroutines' pending reads
+	// and tells the remote command to stop, so a fail-fast cancellation
+	// disconnects promptly instead of leaking the connection until the
+	// command finishes (or CommandTimeout fires) on its own.
+	stopWatch := context.AfterFunc(s.ctx, func() { session.Close() })
+
+	go func() {
+		defer client.Close()
+		defer stopWatch()
+
+		if timeout <= 0 {
+			select {
+			case err := <-waitChan:
+				finishSession(err, doneChan, errChan)
+			case <-s.ctx.Done():
+				doneChan <- false
+				errChan <- s.ctx.Err()
+			}
+			return
+		}
+
+		select {
+		case err := <-waitChan:
+			finishSession(err, doneChan, errChan)
+		case <-time.After(time.Duration(timeout) * time.Second):
+			session.Close()
+			doneChan <- false
+		case <-s.ctx.Done():
+			doneChan <- false
+			errChan <- s.ctx.Err()
+		}
+	}()
+
+	return stdoutChan, stderrChan, doneChan, errChan, nil
+}
+
+// finishSession reports a completed (not timed out) session's result.
+func finishSession(err error, doneChan chan<- bool, errChan chan<- error) {
+	if err != nil {
+		if exitErr, ok := err.(*ssh.ExitError); ok {
+			errChan <- &exitCodeError{code: exitErr.ExitStatus()}
+		} else {
+			errChan <- err
+		}
+	}
+	doneChan <- true
+}
+
+// exitCodeError carries a remote command's real exit status, so callers can
+// propagate it (e.g. into HostResult.ExitCode) instead of just its text.
+type exitCodeError struct {
+	code int
+}
+
+func (e *exitCodeError) Error() string {
+	return fmt.Sprintf("command exited with status %d", e.code)
+}
+
+// scanLines copies lines from r onto lines until r is exhausted or ctx is
+// cancelled, then signals wg. Sending on lines is itself select-guarded so a
+// cancelled reader with nobody left to drain lines doesn't block forever.
+func scanLines(ctx context.Context, r interface {
+	Read(p []byte) (n int, err error)
+}, lines chan<- string, wg *sync.WaitGroup) {
+	defer wg.Done()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		select {
+		case lines <- scanner.Text():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// upload transfers Config.Source onto host under Config.Target over SFTP,
+// using the same SSH and proxy settings as exec, before the script runs. It
+// aborts promptly if ctx is cancelled, so fail-fast doesn't wait out an
+// in-flight transfer.
+func (p Plugin) upload(ctx context.Context, host string) error {
+	files, err := expandSources(p.Config.Source)
+	if err != nil {
+		return err
+	}
+
+	client, err := p.dial(ctx, host)
+	if err != nil {
+		return fmt.Errorf("upload: failed to connect to %s: %w", host, err)
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return fmt.Errorf("upload: failed to start sftp session on %s: %w", host, err)
+	}
+	defer sftpClient.Close()
+
+	for _, src := range files {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		if err := p.uploadFile(ctx, sftpClient, host, src); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expandSources resolves glob patterns in sources to a deduplicated list of
+// files, skipping directories. Files come in the order of their patterns,
+// each pattern's matches sorted.
+func expandSources(sources []string) ([]string, error) {
+	seen := map[string]bool{}
+	var files []string
+
+	for _, pattern := range sources {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("upload: invalid Source pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("upload: Source pattern %q matched no files", pattern)
+		}
+
+		for _, match := range matches {
+			info, err := os.Stat(match)
+			if err != nil {
+				return nil, fmt.Errorf("upload: failed to stat %s: %w", match, err)
+			}
+			if info.IsDir() || seen[match] {
+				continue
+			}
+			seen[match] = true
+			files = append(files, match)
+		}
+	}
+
+	return files, nil
+}
+
+// remoteTarget joins target onto local after stripping the first
+// stripComponents path elements from it. A leading "/" is not counted as an
+// element, and the file name itself is always kept.
+func remoteTarget(target, local string, stripComponents int) string {
+	parts := strings.Split(strings.TrimPrefix(filepath.ToSlash(local), "/"), "/")
+	if stripComponents > 0 && stripComponents < len(parts) {
+		parts = parts[stripComponents:]
+	} else if stripComponents >= len(parts) {
+		parts = parts[len(parts)-1:]
+	}
+
+	return path.Join(target, path.Join(parts...))
+}
+
+func (p Plugin) uploadFile(ctx context.Context, client *sftp.Client, host, local string) error {
+	info, err := os.Stat(local)
+	if err != nil {
+		return fmt.Errorf("upload: failed to stat %s: %w", local, err)
+	}
+
+	remote := remoteTarget(p.Config.Target, local, p.Config.StripComponents)
+
+	if !p.Config.Overwrite {
+		if _, err := client.Stat(remote); err == nil {
+			return fmt.Errorf("upload: %s already exists on %s and Overwrite is not set", remote, host)
+		}
+	}
+
+	if err := client.MkdirAll(path.Dir(remote)); err != nil {
+		return fmt.Errorf("upload: failed to create %s on %s: %w", path.Dir(remote), host, err)
+	}
+
+	src, err := os.Open(local)
+	if err != nil {
+		return fmt.Errorf("upload: failed to open %s: %w", local, err)
+	}
+	defer src.Close()
+
+	dst, err := client.Create(remote)
+	if err != nil {
+		return fmt.Errorf("upload: failed to create %s on %s: %w", remote, host, err)
+	}
+	defer dst.Close()
+
+	p.log(host, fmt.Sprintf("uploading %s -> %s (%d bytes)", local, remote, info.Size()))
+
+	type copyResult struct {
+		written int64
+		err     error
+	}
+	copyDone := make(chan copyResult, 1)
+	go func() {
+		written, err := io.Copy(dst, src)
+		copyDone <- copyResult{written, err}
+	}()
+
+	var written int64
+	select {
+	case <-ctx.Done():
+		// Force the in-flight Read/Write to unblock, then wait for the
+		// copy goroutine to actually exit before returning, so it can't
+		// still be using src/dst once the caller's deferred client/sftp
+		// Close runs.
+		src.Close()
+		dst.Close()
+		<-copyDone
+		return ctx.Err()
+	case result := <-copyDone:
+		if result.err != nil {
+			return fmt.Errorf("upload: failed to transfer %s to %s on %s: %w", local, remote, host, result.err)
+		}
+		written = result.written
+	}
+
+	if err := client.Chmod(remote, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("upload: failed to set mode on %s on %s: %w", remote, host, err)
+	}
+
+	p.log(host, fmt.Sprintf("uploaded %s (%d bytes)", remote, written))
+
+	return nil
+}